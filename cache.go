@@ -1,36 +1,250 @@
 package main
 
-var minShards = 1024
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultShards is the shard count used when Config.Shards is left at 0.
+const DefaultShards = 1024
+
+// cleanupInterval is how often each shard is swept for expired entries.
+const cleanupInterval = time.Second
+
+// ErrShardsNotPowerOfTwo is returned by newCache when Config.Shards isn't a
+// power of two, since sharding relies on a bitmask rather than a modulo.
+var ErrShardsNotPowerOfTwo = errors.New("shards must be a power of two")
+
+// Config configures a cache instance.
+type Config struct {
+	// Shards is the number of shards the cache is split into. It must be a
+	// power of two. 0 defaults to DefaultShards.
+	Shards int
+	// Hasher hashes keys to route them to a shard. A nil Hasher defaults to
+	// fnv64a.
+	Hasher Hasher
+	// LifeWindow is how long an entry stays valid after being set. 0 disables expiry.
+	LifeWindow time.Duration
+	// MaxShardBytes bounds the size of each shard's backing array. 0 means unbounded.
+	MaxShardBytes int
+	// Disk enables a second, on-disk tier that large or evicted entries
+	// spill to. A nil Disk keeps the cache memory-only.
+	Disk *DiskConfig
+}
+
+// HardMaxCacheSize returns the upper bound, in bytes, that a cache built with
+// this config can grow to across all of its shards.
+func (c Config) HardMaxCacheSize() int {
+	shards := c.Shards
+	if shards == 0 {
+		shards = DefaultShards
+	}
+	return c.MaxShardBytes * shards
+}
+
+// Stats holds runtime counters for a cache, aggregated across all shards.
+type Stats struct {
+	Hits             uint64
+	Misses           uint64
+	EvictionsNoSpace uint64
+	EvictionsExpired uint64
+	DiskHits         uint64
+	DiskMisses       uint64
+	DiskWriteBacklog uint64
+}
 
 type cache struct {
-	shards []*cacheShard
-	hash   fnv64a
+	shards    []*cacheShard
+	disks     []*diskShard // nil unless config.Disk is set
+	hash      Hasher
+	shardMask uint64
+	config    Config
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
-func newCache() *cache {
+// newCache builds a cache according to config. It returns
+// ErrShardsNotPowerOfTwo if config.Shards is set and isn't a power of two.
+func newCache(config Config) (*cache, error) {
+	shards := config.Shards
+	if shards == 0 {
+		shards = DefaultShards
+	}
+	if shards&(shards-1) != 0 {
+		return nil, ErrShardsNotPowerOfTwo
+	}
+
+	hasher := config.Hasher
+	if hasher == nil {
+		hasher = newDefaultHasher()
+	}
+
 	cache := &cache{
-		hash:   newDefaultHasher(),
-		shards: make([]*cacheShard, minShards),
+		hash:      hasher,
+		shards:    make([]*cacheShard, shards),
+		shardMask: uint64(shards - 1),
+		config:    config,
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < shards; i++ {
+		cache.shards[i] = initNewShard(config.LifeWindow, config.MaxShardBytes)
 	}
-	for i := 0; i < minShards; i++ {
-		cache.shards[i] = initNewShard()
+
+	if config.Disk != nil {
+		cache.disks = make([]*diskShard, shards)
+		for i := 0; i < shards; i++ {
+			disk, err := newDiskShard(*config.Disk, i)
+			if err != nil {
+				return nil, err
+			}
+			cache.disks[i] = disk
+		}
 	}
 
-	return cache
+	if config.LifeWindow > 0 {
+		cache.wg.Add(1)
+		go cache.cleanupLoop()
+	}
+
+	return cache, nil
+}
+
+// cleanupLoop periodically evicts expired entries from every shard until
+// Close is called.
+func (c *cache) cleanupLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := uint64(time.Now().Unix())
+			for _, shard := range c.shards {
+				shard.cleanUp(now)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close stops the background eviction goroutine and any disk shards. It is
+// safe to call on a cache created with LifeWindow 0 and/or no Disk tier,
+// safe to call concurrently with set/get, and safe to call more than once.
+func (c *cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		for _, disk := range c.disks {
+			if e := disk.close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
 }
 
 func (c *cache) getShard(hashedKey uint64) (shard *cacheShard) {
-	return c.shards[hashedKey&uint64(minShards-1)]
+	return c.shards[hashedKey&c.shardMask]
 }
 
-func (c *cache) set(key string, value []byte) {
+// diskThresholdBytes returns the entry size, in bytes, above which set spills
+// straight to disk instead of memory. 0 means the disk tier is never used
+// for this reason (only as an overflow target).
+func (c *cache) diskThresholdBytes() int {
+	if c.config.MaxShardBytes <= 0 {
+		return 0
+	}
+	return c.config.MaxShardBytes / 4
+}
+
+func (c *cache) set(key string, value []byte) error {
 	hashedKey := c.hash.Sum64(key)
+
+	if c.disks != nil {
+		if threshold := c.diskThresholdBytes(); threshold > 0 && len(key)+len(value) > threshold {
+			return c.writeToDisk(hashedKey, key, value)
+		}
+	}
+
 	shard := c.getShard(hashedKey)
-	shard.set(hashedKey, value)
+	err := shard.set(hashedKey, key, value)
+	if err == ErrShardFull && c.disks != nil {
+		return c.writeToDisk(hashedKey, key, value)
+	}
+	return err
+}
+
+func (c *cache) writeToDisk(hashedKey uint64, key string, value []byte) error {
+	disk := c.disks[hashedKey&c.shardMask]
+	if !disk.enqueue(hashedKey, key, value) {
+		return ErrDiskBacklogFull
+	}
+	return nil
 }
 
 func (c *cache) get(key string) ([]byte, error) {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
-	return shard.get(key, hashedKey)
+
+	value, err := shard.get(key, hashedKey)
+	if err == nil || c.disks == nil {
+		return value, err
+	}
+
+	disk := c.disks[hashedKey&c.shardMask]
+	value, ok := disk.read(hashedKey)
+	if !ok {
+		return nil, err
+	}
+
+	// Promote the entry back into memory; if there's no room it simply
+	// stays disk-resident, the value found on disk is returned regardless.
+	_ = shard.set(hashedKey, key, value)
+	return value, nil
+}
+
+// Delete removes key's entry, if any, from both the memory shard and (when a
+// disk tier is configured) the disk tier, so a key promoted from disk by get
+// or spilled there directly by a full shard can't be served again afterwards.
+// It returns ErrEntryNotFound only if the key was present in neither tier.
+func (c *cache) Delete(key string) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	memErr := shard.del(hashedKey)
+
+	var diskFound bool
+	if c.disks != nil {
+		disk := c.disks[hashedKey&c.shardMask]
+		diskFound = disk.delete(hashedKey)
+	}
+
+	if memErr == nil || diskFound {
+		return nil
+	}
+	return memErr
+}
+
+// Stats aggregates Hits, Misses, eviction and disk-tier counters across
+// every shard.
+func (c *cache) Stats() Stats {
+	var stats Stats
+	for _, shard := range c.shards {
+		stats.Hits += atomic.LoadUint64(&shard.hits)
+		stats.Misses += atomic.LoadUint64(&shard.misses)
+		stats.EvictionsNoSpace += atomic.LoadUint64(&shard.evictionsNoSpace)
+		stats.EvictionsExpired += atomic.LoadUint64(&shard.evictionsExpired)
+	}
+	for _, disk := range c.disks {
+		stats.DiskHits += atomic.LoadUint64(&disk.hits)
+		stats.DiskMisses += atomic.LoadUint64(&disk.misses)
+		stats.DiskWriteBacklog += atomic.LoadUint64(&disk.backlog)
+	}
+	return stats
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func Test_cache_set_and_get(t *testing.T) {
@@ -16,10 +17,15 @@ func Test_cache_set_and_get(t *testing.T) {
 		{key: "secret", value: []byte("value")},
 	}
 
-	cache := newCache()
+	cache, err := newCache(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, tt := range tests {
 		t.Run(tt.key, func(t *testing.T) {
-			cache.set(tt.key, tt.value)
+			if err := cache.set(tt.key, tt.value); err != nil {
+				t.Fatal(err)
+			}
 			value, err := cache.get(tt.key)
 			if err != nil {
 				t.Error(err)
@@ -33,8 +39,358 @@ func Test_cache_set_and_get(t *testing.T) {
 	}
 }
 
+func Test_cache_entry_expires_after_lifeWindow(t *testing.T) {
+	// Exercise the shard directly so the background cleanupLoop (which would
+	// otherwise race this test and evict the entry first) isn't involved.
+	shard := initNewShard(time.Second, 0)
+	hashedKey := newDefaultHasher().Sum64("mykey")
+
+	if err := shard.set(hashedKey, "mykey", []byte("the value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := shard.get("mykey", hashedKey); err != nil {
+		t.Fatalf("expected entry to be readable before expiry, got %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if _, err := shard.get("mykey", hashedKey); err != ErrEntryExpired {
+		t.Errorf("expected ErrEntryExpired, got %v", err)
+	}
+}
+
+func Test_shard_evicts_oldest_entry_when_full(t *testing.T) {
+	shard := initNewShard(0, 64)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		hashedKey := newDefaultHasher().Sum64(key)
+		if err := shard.set(hashedKey, key, []byte("0123456789")); err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+	}
+
+	oldest := newDefaultHasher().Sum64("key_0")
+	if _, err := shard.get("key_0", oldest); err != ErrEntryNotFound {
+		t.Errorf("expected the oldest entry to have been evicted, got %v", err)
+	}
+
+	newest := newDefaultHasher().Sum64("key_9")
+	if _, err := shard.get("key_9", newest); err != nil {
+		t.Errorf("expected the newest entry to still be present, got %v", err)
+	}
+
+	if shard.evictionsNoSpace == 0 {
+		t.Error("expected evictionsNoSpace to be greater than 0")
+	}
+}
+
+func Test_cache_iterator_yields_every_entry(t *testing.T) {
+	cache, err := newCache(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		"mykey":    []byte("the value"),
+		"otherkey": []byte("other value"),
+		"secret":   []byte("value"),
+	}
+	for key, value := range want {
+		if err := cache.set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string][]byte, len(want))
+	it := cache.Iterator()
+	for it.Next() {
+		got[it.Key()] = it.Value()
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for key, value := range want {
+		if bytes.Compare(got[key], value) != 0 {
+			t.Errorf("key %q: got %s, want %s", key, got[key], value)
+		}
+	}
+}
+
+func Test_cache_with_custom_hasher(t *testing.T) {
+	cache, err := newCache(Config{Hasher: newXXHash64()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.set("mykey", []byte("the value")); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := cache.get("mykey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(value, []byte("the value")) != 0 {
+		t.Errorf("got %s expected %s", string(value), "the value")
+	}
+}
+
+func Test_cache_delete(t *testing.T) {
+	cache, err := newCache(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.set("mykey", []byte("the value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Delete("mykey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get("mykey"); err != ErrEntryNotFound {
+		t.Errorf("expected ErrEntryNotFound after delete, got %v", err)
+	}
+	if err := cache.Delete("mykey"); err != ErrEntryNotFound {
+		t.Errorf("expected ErrEntryNotFound deleting an already-deleted key, got %v", err)
+	}
+}
+
+func Test_cache_delete_reaches_promoted_disk_entry(t *testing.T) {
+	cache, err := newCache(Config{
+		MaxShardBytes: 64,
+		Disk: &DiskConfig{
+			Dir:               t.TempDir(),
+			ShardingBlockSize: 512,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	big := bytes.Repeat([]byte("x"), 100)
+	if err := cache.set("bigkey", big); err != nil {
+		t.Fatal(err)
+	}
+
+	// Poll until the async write lands on disk, then get once to promote the
+	// entry back into memory so it lives in both tiers.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := cache.get("bigkey"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := cache.Delete("bigkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get("bigkey"); err != ErrEntryNotFound {
+		t.Errorf("expected ErrEntryNotFound for a key deleted after disk promotion, got %v", err)
+	}
+}
+
+func Test_cache_delete_reaches_disk_only_entry(t *testing.T) {
+	cache, err := newCache(Config{
+		MaxShardBytes: 64,
+		Disk: &DiskConfig{
+			Dir:               t.TempDir(),
+			ShardingBlockSize: 512,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	big := bytes.Repeat([]byte("x"), 100)
+	if err := cache.set("bigkey", big); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the async write time to land on disk, without ever calling get
+	// (which would promote the entry into memory).
+	time.Sleep(100 * time.Millisecond)
+
+	if err := cache.Delete("bigkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get("bigkey"); err != ErrEntryNotFound {
+		t.Errorf("expected ErrEntryNotFound for a disk-only key after delete, got %v", err)
+	}
+}
+
+func Test_shard_compacts_after_enough_deletes(t *testing.T) {
+	shard := initNewShard(0, 0)
+
+	keys := make([]string, 20)
+	for i := range keys {
+		key := fmt.Sprintf("key_%d", i)
+		keys[i] = key
+		hashedKey := newDefaultHasher().Sum64(key)
+		if err := shard.set(hashedKey, key, []byte("0123456789")); err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+	}
+
+	// Delete enough of the entries to cross the compaction threshold.
+	for _, key := range keys[:15] {
+		hashedKey := newDefaultHasher().Sum64(key)
+		if err := shard.del(hashedKey); err != nil {
+			t.Fatalf("del %q: %v", key, err)
+		}
+	}
+
+	if shard.head != 1 {
+		t.Errorf("expected compaction to reset head to 1, got %d", shard.head)
+	}
+	if shard.freedBytes != 0 {
+		t.Errorf("expected compaction to reset freedBytes, got %d", shard.freedBytes)
+	}
+
+	for _, key := range keys[15:] {
+		hashedKey := newDefaultHasher().Sum64(key)
+		if _, err := shard.get(key, hashedKey); err != nil {
+			t.Errorf("expected %q to survive compaction, got %v", key, err)
+		}
+	}
+}
+
+func Test_shard_removeOldestEntry_skips_a_deleted_entry_without_compacting(t *testing.T) {
+	shard := initNewShard(0, 0)
+
+	keys := make([]string, 30)
+	for i := range keys {
+		key := fmt.Sprintf("key_%d", i)
+		keys[i] = key
+		hashedKey := newDefaultHasher().Sum64(key)
+		if err := shard.set(hashedKey, key, []byte("0123456789")); err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+	}
+
+	// Delete a single entry near the head: freedBytes stays well under the
+	// 25% compaction threshold, so compact() must not fire.
+	hashedKey := newDefaultHasher().Sum64(keys[0])
+	if err := shard.del(hashedKey); err != nil {
+		t.Fatal(err)
+	}
+	if shard.head != 1 {
+		t.Fatalf("compact() fired unexpectedly, head = %d", shard.head)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !shard.removeOldestEntry() {
+			t.Fatalf("removeOldestEntry %d: expected an entry to be removed", i)
+		}
+	}
+
+	if shard.head > shard.tail {
+		t.Errorf("head (%d) ran past tail (%d): scan misread stale payload bytes as a header", shard.head, shard.tail)
+	}
+
+	for _, key := range keys[4:] {
+		hashedKey := newDefaultHasher().Sum64(key)
+		if _, err := shard.get(key, hashedKey); err != nil {
+			t.Errorf("expected %q to still be present, got %v", key, err)
+		}
+	}
+}
+
+func Test_cache_spills_large_entries_to_disk(t *testing.T) {
+	cache, err := newCache(Config{
+		MaxShardBytes: 64,
+		Disk: &DiskConfig{
+			Dir:               t.TempDir(),
+			ShardingBlockSize: 512,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	big := bytes.Repeat([]byte("x"), 100)
+	if err := cache.set("bigkey", big); err != nil {
+		t.Fatal(err)
+	}
+
+	// The write is asynchronous, so poll briefly for it to land on disk.
+	deadline := time.Now().Add(time.Second)
+	var value []byte
+	for time.Now().Before(deadline) {
+		value, err = cache.get("bigkey")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected bigkey to be readable from disk, got %v", err)
+	}
+	if bytes.Compare(value, big) != 0 {
+		t.Errorf("got %d bytes back, want %d", len(value), len(big))
+	}
+
+	if stats := cache.Stats(); stats.DiskHits == 0 {
+		t.Error("expected DiskHits to be greater than 0")
+	}
+}
+
+func Test_cache_Close_concurrent_with_set_does_not_panic(t *testing.T) {
+	cache, err := newCache(Config{
+		MaxShardBytes: 64,
+		Disk: &DiskConfig{
+			Dir:               t.TempDir(),
+			ShardingBlockSize: 512,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("x"), 100)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.set("bigkey", big)
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-done
+
+	if err := cache.Close(); err != nil {
+		t.Errorf("second Close should be a no-op, got %v", err)
+	}
+}
+
+func Test_newCache_rejects_non_power_of_two_shards(t *testing.T) {
+	if _, err := newCache(Config{Shards: 100}); err != ErrShardsNotPowerOfTwo {
+		t.Errorf("expected ErrShardsNotPowerOfTwo, got %v", err)
+	}
+}
+
 func BenchmarkCache_Set(b *testing.B) {
-	cache := newCache()
+	cache, err := newCache(Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
 	for i := 0; i < 100; i++ {
 		cache.set(fmt.Sprintf("mykey_%d", i), []byte("value"))
 	}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	diskHeaderSize     = 8   // length prefix for a disk-resident entry
+	diskWriteQueueSize = 256 // bounded so set() never blocks on disk I/O
+)
+
+// ErrDiskBacklogFull is returned when a disk shard's write queue is full and
+// the entry could not be spilled to disk.
+var ErrDiskBacklogFull = errors.New("disk write queue is full")
+
+// DiskConfig enables the optional on-disk tier that backs entries too large
+// (or too numerous) to keep in memory.
+type DiskConfig struct {
+	// Dir is the directory disk shard files are created in.
+	Dir string
+	// ShardingBlockSize aligns entries on disk to fixed-size blocks.
+	ShardingBlockSize int64
+	// MaxSizeBytes bounds the size of each disk shard file. 0 means unbounded.
+	MaxSizeBytes int64
+}
+
+// diskShard is the on-disk counterpart of a cacheShard: entries spilled out
+// of memory are appended here in fixed-size blocks by an async write worker
+// reading off a bounded channel, so set never blocks on I/O.
+type diskShard struct {
+	file      *os.File
+	blockSize int64
+	maxSize   int64
+	tail      int64
+	lock      sync.Mutex
+	offsets   map[uint64]int64
+	writes    chan diskWrite
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	hits, misses, backlog uint64
+}
+
+type diskWrite struct {
+	hashedKey uint64
+	key       string
+	value     []byte
+}
+
+func newDiskShard(cfg DiskConfig, index int) (*diskShard, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(cfg.Dir, fmt.Sprintf("shard-%d.cache", index)), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diskShard{
+		file:      f,
+		blockSize: cfg.ShardingBlockSize,
+		maxSize:   cfg.MaxSizeBytes,
+		offsets:   make(map[uint64]int64),
+		writes:    make(chan diskWrite, diskWriteQueueSize),
+		stop:      make(chan struct{}),
+	}
+	go d.writeLoop()
+	return d, nil
+}
+
+// writeLoop drains queued writes onto disk so set never blocks on I/O, until
+// close stops it.
+func (d *diskShard) writeLoop() {
+	for {
+		select {
+		case w := <-d.writes:
+			atomic.AddUint64(&d.backlog, ^uint64(0)) // decrement
+			_ = d.writeEntry(w.hashedKey, w.key, w.value)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// enqueue schedules an async write, reporting whether it was accepted. The
+// write queue is bounded so a slow disk can never block the caller, and
+// enqueue never sends on writes after close — producers and close can race
+// safely because the channel producers write to is never closed.
+func (d *diskShard) enqueue(hashedKey uint64, key string, value []byte) bool {
+	select {
+	case d.writes <- diskWrite{hashedKey: hashedKey, key: key, value: value}:
+		atomic.AddUint64(&d.backlog, 1)
+		return true
+	case <-d.stop:
+		return false
+	default:
+		return false
+	}
+}
+
+func (d *diskShard) writeEntry(hashedKey uint64, key string, value []byte) error {
+	blob := wrapEntry(hashedKey, 0, key, value)
+	header := make([]byte, diskHeaderSize)
+	binary.LittleEndian.PutUint64(header, uint64(len(blob)))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	offset := d.tail
+	if d.maxSize > 0 && offset+diskHeaderSize+int64(len(blob)) > d.maxSize {
+		return errors.New("disk shard is full")
+	}
+	if _, err := d.file.WriteAt(header, offset); err != nil {
+		return err
+	}
+	if _, err := d.file.WriteAt(blob, offset+diskHeaderSize); err != nil {
+		return err
+	}
+	d.offsets[hashedKey] = offset
+	d.tail = d.alignedEnd(offset + diskHeaderSize + int64(len(blob)))
+	return nil
+}
+
+// alignedEnd rounds end up to the next ShardingBlockSize boundary so entries
+// stay block-aligned on disk.
+func (d *diskShard) alignedEnd(end int64) int64 {
+	if d.blockSize <= 0 {
+		return end
+	}
+	if rem := end % d.blockSize; rem != 0 {
+		end += d.blockSize - rem
+	}
+	return end
+}
+
+// read looks up a key spilled to disk, reporting whether it was found.
+func (d *diskShard) read(hashedKey uint64) ([]byte, bool) {
+	d.lock.Lock()
+	offset, ok := d.offsets[hashedKey]
+	d.lock.Unlock()
+	if !ok {
+		atomic.AddUint64(&d.misses, 1)
+		return nil, false
+	}
+
+	header := make([]byte, diskHeaderSize)
+	if _, err := d.file.ReadAt(header, offset); err != nil {
+		atomic.AddUint64(&d.misses, 1)
+		return nil, false
+	}
+	size := binary.LittleEndian.Uint64(header)
+	blob := make([]byte, size)
+	if _, err := d.file.ReadAt(blob, offset+diskHeaderSize); err != nil {
+		atomic.AddUint64(&d.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&d.hits, 1)
+	return readEntry(valueFromBlob(blob)), true
+}
+
+// delete removes hashedKey's entry from offsets, if present, reporting
+// whether it was found. Like cacheShard.del, the bytes are left untouched on
+// disk — removing the offset is what hides the entry from read, and the
+// space is never reclaimed (the disk tier has no compact()).
+func (d *diskShard) delete(hashedKey uint64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.offsets[hashedKey]; !ok {
+		return false
+	}
+	delete(d.offsets, hashedKey)
+	return true
+}
+
+// close stops writeLoop and closes the backing file. It's safe to call
+// concurrently with enqueue, and safe to call more than once.
+func (d *diskShard) close() error {
+	var err error
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		err = d.file.Close()
+	})
+	return err
+}
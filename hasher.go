@@ -0,0 +1,30 @@
+package main
+
+// Hasher computes a 64-bit hash for a cache key so entries can be routed to
+// shards. Implementations should distribute keys uniformly across the
+// uint64 range.
+type Hasher interface {
+	Sum64(key string) uint64
+}
+
+// fnv64a is the default Hasher, a straightforward implementation of the
+// 64-bit FNV-1a hash (https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function).
+type fnv64a struct{}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func newDefaultHasher() Hasher {
+	return fnv64a{}
+}
+
+func (fnv64a) Sum64(key string) uint64 {
+	var h uint64 = fnvOffset64
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= fnvPrime64
+	}
+	return h
+}
@@ -0,0 +1,50 @@
+package main
+
+// iteratorEntry is a single key/value pair captured by cacheShard.snapshotEntries.
+type iteratorEntry struct {
+	key   string
+	value []byte
+}
+
+// EntryIterator walks every shard of a cache, yielding the (key, value) pairs
+// stored in it. It is useful for dumping, restoring or scraping cache
+// contents. A shard is snapshotted under its RLock one at a time, so no lock
+// is held while the caller inspects Key/Value.
+type EntryIterator struct {
+	cache      *cache
+	shardIndex int
+	entries    []iteratorEntry
+	pos        int
+}
+
+// Iterator returns an EntryIterator positioned before the first entry.
+func (c *cache) Iterator() *EntryIterator {
+	return &EntryIterator{cache: c, pos: -1}
+}
+
+// Next advances the iterator and reports whether a further entry is
+// available.
+func (it *EntryIterator) Next() bool {
+	for {
+		if it.pos+1 < len(it.entries) {
+			it.pos++
+			return true
+		}
+		if it.shardIndex >= len(it.cache.shards) {
+			return false
+		}
+		it.entries = it.cache.shards[it.shardIndex].snapshotEntries()
+		it.shardIndex++
+		it.pos = -1
+	}
+}
+
+// Key returns the key of the current entry.
+func (it *EntryIterator) Key() string {
+	return it.entries[it.pos].key
+}
+
+// Value returns the value of the current entry.
+func (it *EntryIterator) Value() []byte {
+	return it.entries[it.pos].value
+}
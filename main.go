@@ -1,10 +1,21 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 func main() {
-	cache := newCache()
-	cache.set("key", []byte("the value"))
+	cache, err := newCache(Config{LifeWindow: 10 * time.Minute})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer cache.Close()
+
+	if err := cache.set("key", []byte("the value")); err != nil {
+		fmt.Println(err)
+	}
 
 	value, err := cache.get("key")
 	if err != nil {
@@ -3,44 +3,182 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	headerEntrySize = 4
-	defaultValue    = 1024 // For this example we use 1024 like default value.
+	headerEntrySize      = 4 // length prefix for the whole stored blob
+	hashedKeySize        = 8 // hashedKey, embedded so an expired/evicted entry can be removed from items
+	timestampSizeInBytes = 8
+	keyLengthSize        = 2 // length prefix for the original key, embedded for the Iterator
+	defaultValue         = 1024 // For this example we use 1024 like default value.
 )
 
+// ErrEntryNotFound is returned when a key has no entry in the shard.
+var ErrEntryNotFound = errors.New("key not found")
+
+// ErrEntryExpired is returned when a key's entry is still present but has
+// outlived the cache's lifeWindow.
+var ErrEntryExpired = errors.New("entry expired")
+
+// ErrShardFull is returned by push when an entry doesn't fit even after
+// evicting every other entry in the shard.
+var ErrShardFull = errors.New("shard is full")
+
+// compactionThresholdRatio triggers a compaction once freedBytes (bytes
+// reclaimed by Delete) exceeds this fraction of tail.
+const compactionThresholdRatio = 0.25
+
 type cacheShard struct {
-	items        map[uint64]uint32
+	items        map[uint64]uint64
 	lock         sync.RWMutex
 	array        []byte
-	tail         int
+	head         int // offset of the oldest, still-live entry
+	tail         int // offset the next entry will be written at
 	headerBuffer []byte
+	lifeWindow   time.Duration
+
+	// maxShardBytes bounds len(array); 0 means unbounded.
+	maxShardBytes int
+
+	// freedBytes tracks bytes reclaimed by del since the last compaction.
+	freedBytes uint64
+
+	hits             uint64
+	misses           uint64
+	evictionsNoSpace uint64
+	evictionsExpired uint64
 }
 
-func initNewShard() *cacheShard {
+func initNewShard(lifeWindow time.Duration, maxShardBytes int) *cacheShard {
 	return &cacheShard{
-		items:        make(map[uint64]uint32, defaultValue),
-		array:        make([]byte, defaultValue),
-		tail:         1,
-		headerBuffer: make([]byte, headerEntrySize),
+		items:         make(map[uint64]uint64, defaultValue),
+		array:         make([]byte, defaultValue),
+		head:          1,
+		tail:          1,
+		headerBuffer:  make([]byte, headerEntrySize),
+		lifeWindow:    lifeWindow,
+		maxShardBytes: maxShardBytes,
 	}
 }
 
-func (s *cacheShard) set(hashedKey uint64, entry []byte) {
-	w := wrapEntry(entry)
+func (s *cacheShard) set(hashedKey uint64, key string, entry []byte) error {
+	w := wrapEntry(hashedKey, uint64(time.Now().Unix()), key, entry)
 	s.lock.Lock()
-	index := s.push(w)
-	s.items[hashedKey] = uint32(index)
+	index, err := s.push(w)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.items[hashedKey] = uint64(index)
 	s.lock.Unlock()
+	return nil
+}
+
+// del removes hashedKey's entry. Its bytes are left untouched in the array —
+// removing it from items is what hides it from get, head-scans and the
+// Iterator — and are only reclaimed once compact() rewrites the shard.
+// Zeroing the entry's header in place was tried and reverted: head-scans
+// (removeOldestEntry, cleanUp) only skip a zeroed header's own 4 bytes, not
+// the payload still sitting behind it, so the next scan step reinterprets
+// stale payload bytes as a new header/hashedKey and can wedge head forever
+// or delete an unrelated live key it collides with.
+func (s *cacheShard) del(hashedKey uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	offset, ok := s.items[hashedKey]
+	if !ok {
+		return ErrEntryNotFound
+	}
+
+	itemIndex := int(offset)
+	blockSize := int(binary.LittleEndian.Uint32(s.array[itemIndex : itemIndex+headerEntrySize]))
+	delete(s.items, hashedKey)
+	s.freedBytes += uint64(headerEntrySize + blockSize)
+
+	if float64(s.freedBytes) > float64(s.tail)*compactionThresholdRatio {
+		s.compact()
+	}
+	return nil
 }
 
-func (s *cacheShard) push(data []byte) int {
+// push appends data to the tail of the array, evicting the oldest entries
+// (mirroring removeOldestEntry(NoSpace) in bigcache) until the entry fits
+// within maxShardBytes. It fails with ErrShardFull if the shard is empty and
+// the entry still doesn't fit. Once eviction has freed logical space, the
+// array is compacted or grown so the entry can physically be written.
+func (s *cacheShard) push(data []byte) (int, error) {
 	dataLen := len(data)
+	needed := headerEntrySize + dataLen
+
+	for s.maxShardBytes > 0 && (s.tail-s.head)+needed > s.maxShardBytes {
+		if !s.removeOldestEntry() {
+			return 0, ErrShardFull
+		}
+		atomic.AddUint64(&s.evictionsNoSpace, 1)
+	}
+
+	if s.tail+needed > len(s.array) {
+		s.compact()
+	}
+	if s.tail+needed > len(s.array) {
+		s.grow(s.tail + needed)
+	}
+
 	index := s.tail
 	s.save(data, dataLen)
-	return index
+	return index, nil
+}
+
+// compact rewrites every live entry contiguously from the start of the
+// array, in their original order, remapping each surviving items[hashedKey]
+// offset. This reclaims space left behind both by entries evicted off the
+// head and by tombstones del left in the middle of the array.
+func (s *cacheShard) compact() {
+	type liveEntry struct {
+		hashedKey uint64
+		offset    int
+	}
+
+	live := make([]liveEntry, 0, len(s.items))
+	for hashedKey, offset := range s.items {
+		live = append(live, liveEntry{hashedKey, int(offset)})
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].offset < live[j].offset })
+
+	newArray := make([]byte, len(s.array))
+	newTail := 1
+	for _, e := range live {
+		blockSize := int(binary.LittleEndian.Uint32(s.array[e.offset : e.offset+headerEntrySize]))
+		entrySize := headerEntrySize + blockSize
+		newIndex := newTail
+		newTail += copy(newArray[newTail:], s.array[e.offset:e.offset+entrySize])
+		s.items[e.hashedKey] = uint64(newIndex)
+	}
+
+	s.array = newArray
+	s.head = 1
+	s.tail = newTail
+	s.freedBytes = 0
+}
+
+// grow enlarges the backing array to at least minCapacity, doubling its
+// current size and capping the result at maxShardBytes when one is set.
+func (s *cacheShard) grow(minCapacity int) {
+	newCap := len(s.array) * 2
+	if newCap < minCapacity {
+		newCap = minCapacity
+	}
+	if s.maxShardBytes > 0 && newCap > s.maxShardBytes {
+		newCap = s.maxShardBytes
+	}
+	newArray := make([]byte, newCap)
+	copy(newArray, s.array)
+	s.array = newArray
 }
 
 func (s *cacheShard) save(data []byte, len int) {
@@ -60,18 +198,85 @@ func (s *cacheShard) get(key string, hashedKey uint64) ([]byte, error) {
 	itemIndex := int(s.items[hashedKey])
 	if itemIndex == 0 {
 		s.lock.RUnlock()
-		return nil, errors.New("key not found")
+		atomic.AddUint64(&s.misses, 1)
+		return nil, ErrEntryNotFound
 	}
 
 	// Read the first 4 bytes after the index, remember these 4 bytes have the size of the value, so
 	// you can use this to get the size and get the value in the array using index+blockSize to know until what point
 	// you need to read
 	blockSize := int(binary.LittleEndian.Uint32(s.array[itemIndex : itemIndex+headerEntrySize]))
-	entry := s.array[itemIndex+headerEntrySize : itemIndex+headerEntrySize+blockSize]
+	blob := s.array[itemIndex+headerEntrySize : itemIndex+headerEntrySize+blockSize]
+
+	if s.lifeWindow > 0 {
+		ts := binary.LittleEndian.Uint64(blob[hashedKeySize : hashedKeySize+timestampSizeInBytes])
+		if uint64(time.Now().Unix())-ts > uint64(s.lifeWindow/time.Second) {
+			s.lock.RUnlock()
+			atomic.AddUint64(&s.misses, 1)
+			return nil, ErrEntryExpired
+		}
+	}
+
+	entry := valueFromBlob(blob)
 	s.lock.RUnlock()
+	atomic.AddUint64(&s.hits, 1)
 	return readEntry(entry), nil
 }
 
+// snapshotEntries copies every live key/value pair out of the shard under a
+// single RLock, so the Iterator never holds a lock across a user callback.
+func (s *cacheShard) snapshotEntries() []iteratorEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	entries := make([]iteratorEntry, 0, len(s.items))
+	for _, offset := range s.items {
+		itemIndex := int(offset)
+		blockSize := int(binary.LittleEndian.Uint32(s.array[itemIndex : itemIndex+headerEntrySize]))
+		blob := s.array[itemIndex+headerEntrySize : itemIndex+headerEntrySize+blockSize]
+		entries = append(entries, iteratorEntry{
+			key:   keyFromBlob(blob),
+			value: readEntry(valueFromBlob(blob)),
+		})
+	}
+	return entries
+}
+
+// cleanUp pops every entry at the head of the queue whose timestamp is older
+// than lifeWindow, freeing both the byte array and the items map.
+func (s *cacheShard) cleanUp(now uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	window := uint64(s.lifeWindow / time.Second)
+	for s.head < s.tail {
+		entryStart := s.head + headerEntrySize
+		ts := binary.LittleEndian.Uint64(s.array[entryStart+hashedKeySize : entryStart+hashedKeySize+timestampSizeInBytes])
+		if now-ts <= window {
+			break
+		}
+		if !s.removeOldestEntry() {
+			break
+		}
+		atomic.AddUint64(&s.evictionsExpired, 1)
+	}
+}
+
+// removeOldestEntry pops the entry at the head of the queue, deleting it
+// from items (a no-op if del already removed it) and advancing head past it.
+// It reports whether an entry was removed.
+func (s *cacheShard) removeOldestEntry() bool {
+	if s.head >= s.tail {
+		return false
+	}
+	entryStart := s.head + headerEntrySize
+	blockSize := int(binary.LittleEndian.Uint32(s.array[s.head:entryStart]))
+	hashedKey := binary.LittleEndian.Uint64(s.array[entryStart : entryStart+hashedKeySize])
+	delete(s.items, hashedKey)
+	s.head = entryStart + blockSize
+	return true
+}
+
 func readEntry(data []byte) []byte {
 	dst := make([]byte, len(data))
 	copy(dst, data)
@@ -79,10 +284,33 @@ func readEntry(data []byte) []byte {
 	return dst
 }
 
-func wrapEntry(entry []byte) []byte {
-	// You can put more information like a timestamp if you want.
-	blobLength := len(entry)
+// wrapEntry prefixes entry with the hashedKey, a timestamp and the original
+// key. The hashedKey and timestamp let an expired or evicted entry be
+// identified and removed straight from the byte array; the key lets the
+// Iterator yield (key, value) pairs without a reverse hashedKey -> key map.
+func wrapEntry(hashedKey uint64, timestamp uint64, key string, entry []byte) []byte {
+	blobLength := hashedKeySize + timestampSizeInBytes + keyLengthSize + len(key) + len(entry)
 	blob := make([]byte, blobLength)
-	copy(blob, entry)
+	binary.LittleEndian.PutUint64(blob, hashedKey)
+	binary.LittleEndian.PutUint64(blob[hashedKeySize:], timestamp)
+	binary.LittleEndian.PutUint16(blob[hashedKeySize+timestampSizeInBytes:], uint16(len(key)))
+	keyStart := hashedKeySize + timestampSizeInBytes + keyLengthSize
+	copy(blob[keyStart:], key)
+	copy(blob[keyStart+len(key):], entry)
 	return blob
 }
+
+// keyFromBlob reads the original key out of a blob produced by wrapEntry.
+func keyFromBlob(blob []byte) string {
+	keyLen := binary.LittleEndian.Uint16(blob[hashedKeySize+timestampSizeInBytes:])
+	keyStart := hashedKeySize + timestampSizeInBytes + keyLengthSize
+	return string(blob[keyStart : keyStart+int(keyLen)])
+}
+
+// valueFromBlob returns the value portion of a blob produced by wrapEntry,
+// skipping over the hashedKey, timestamp and key header.
+func valueFromBlob(blob []byte) []byte {
+	keyLen := binary.LittleEndian.Uint16(blob[hashedKeySize+timestampSizeInBytes:])
+	valueStart := hashedKeySize + timestampSizeInBytes + keyLengthSize + int(keyLen)
+	return blob[valueStart:]
+}
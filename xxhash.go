@@ -0,0 +1,95 @@
+package main
+
+import "encoding/binary"
+
+// xxHash64 is a Hasher implementing the xxHash64 algorithm
+// (https://github.com/Cyan4973/xxHash), a fast, well-distributed alternative
+// to fnv64a.
+type xxHash64 struct{}
+
+func newXXHash64() Hasher {
+	return xxHash64{}
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (xxHash64) Sum64(key string) uint64 {
+	b := []byte(key)
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := xxPrime1
+		v1 += xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		var v4 uint64
+		v4 -= xxPrime1
+
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for len(b) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+		b = b[8:]
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for len(b) > 0 {
+		h ^= uint64(b[0]) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+		b = b[1:]
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	acc *= xxPrime1
+	return acc
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	acc = acc*xxPrime1 + xxPrime4
+	return acc
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}